@@ -0,0 +1,146 @@
+package db
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-gorp/gorp/v3"
+)
+
+// Migration describes a single schema version, combining the plain-SQL
+// path most versions use with optional Go hooks for versions that need
+// imperative logic (data backfills, cross-row transformations) that can't
+// be expressed as DDL/DML alone. Backends registering a Migration by
+// version only need to supply UpSQL/DownSQL when there's no embedded
+// `<ver>.sql` file backing that version already.
+type Migration struct {
+	Version Version
+
+	UpSQL   string
+	DownSQL string
+
+	// UpFn and DownFn, if set, run in the same transaction as UpSQL/DownSQL
+	// (after it, on the way up; before it, on the way down).
+	UpFn   func(tx *gorp.Transaction) error
+	DownFn func(tx *gorp.Transaction) error
+}
+
+var (
+	migrationRegistryMu sync.Mutex
+	migrationRegistry   = map[string]Migration{}
+)
+
+// RegisterMigration registers a Migration for its version, meant to be
+// called from a package's init(). It panics on a duplicate registration
+// for the same version, since that's a programming error rather than a
+// runtime condition.
+func RegisterMigration(m Migration) {
+	migrationRegistryMu.Lock()
+	defer migrationRegistryMu.Unlock()
+
+	key := m.Version.VersionString()
+	if _, exists := migrationRegistry[key]; exists {
+		panic("db: duplicate migration registered for version " + key)
+	}
+
+	migrationRegistry[key] = m
+}
+
+// GetRegisteredMigration returns the Migration registered for a version,
+// if any package has registered one.
+func GetRegisteredMigration(version Version) (Migration, bool) {
+	migrationRegistryMu.Lock()
+	defer migrationRegistryMu.Unlock()
+
+	m, ok := migrationRegistry[version.VersionString()]
+	return m, ok
+}
+
+// RegisteredMigrationVersions returns the versions with a registered Go
+// migration, in ascending order.
+func RegisteredMigrationVersions() []string {
+	migrationRegistryMu.Lock()
+	defer migrationRegistryMu.Unlock()
+
+	versions := make([]string, 0, len(migrationRegistry))
+	for v := range migrationRegistry {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersionStrings(versions[i], versions[j]) < 0
+	})
+	return versions
+}
+
+// AllVersions returns every version the migrator should walk in order:
+// the versions built into this package (GetVersions) plus any versions
+// a fork or plugin registered via RegisterMigration that aren't already
+// among them. This is what lets RegisterMigration inject a brand-new
+// migration, not just attach a Go hook to an existing one.
+func AllVersions() []Version {
+	builtin := GetVersions()
+
+	known := make(map[string]bool, len(builtin))
+	for _, v := range builtin {
+		known[v.VersionString()] = true
+	}
+
+	all := append([]Version{}, builtin...)
+
+	registered := RegisteredMigrationVersions()
+
+	migrationRegistryMu.Lock()
+	for _, versionString := range registered {
+		if known[versionString] {
+			continue
+		}
+
+		if m, ok := migrationRegistry[versionString]; ok {
+			all = append(all, m.Version)
+		}
+	}
+	migrationRegistryMu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return compareVersionStrings(all[i].VersionString(), all[j].VersionString()) < 0
+	})
+
+	return all
+}
+
+// compareVersionStrings compares two dot-separated version strings
+// (e.g. "2.9.0") numerically component by component, the way HumanoidVersion
+// values sort in practice. A missing trailing component counts as 0, so
+// "2.9" and "2.9.0" compare equal. A non-numeric component falls back to a plain
+// string comparison of that component so this never panics on unexpected input.
+func compareVersionStrings(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		av, bv := "0", "0"
+		if i < len(as) {
+			av = as[i]
+		}
+		if i < len(bs) {
+			bv = bs[i]
+		}
+
+		an, aErr := strconv.Atoi(av)
+		bn, bErr := strconv.Atoi(bv)
+		if aErr == nil && bErr == nil {
+			if an != bn {
+				return an - bn
+			}
+			continue
+		}
+
+		if av != bv {
+			return strings.Compare(av, bv)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,40 @@
+package db
+
+import "testing"
+
+// compareVersionStrings is the one piece of the registry that doesn't
+// depend on the Version type, which isn't part of this package in this
+// tree (see the note on RegisterMigration/AllVersions below) -- so it's
+// the only part unit tests here can exercise directly.
+func TestCompareVersionStrings(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"2.9.0", "2.10.0", -1},
+		{"2.10.0", "2.9.0", 1},
+		{"2.9.0", "2.9.0", 0},
+		{"2.9", "2.9.0", 0},
+		{"2.9.1", "2.9.0", 1},
+		{"2.9.0-rc1", "2.9.0-rc2", -1},
+	}
+
+	for _, c := range cases {
+		got := compareVersionStrings(c.a, c.b)
+		switch {
+		case c.want < 0 && got >= 0:
+			t.Errorf("compareVersionStrings(%q, %q) = %d, want negative", c.a, c.b, got)
+		case c.want > 0 && got <= 0:
+			t.Errorf("compareVersionStrings(%q, %q) = %d, want positive", c.a, c.b, got)
+		case c.want == 0 && got != 0:
+			t.Errorf("compareVersionStrings(%q, %q) = %d, want 0", c.a, c.b, got)
+		}
+	}
+}
+
+// RegisterMigration, GetRegisteredMigration and AllVersions all key off
+// db.Version, but Version itself (and GetVersions) is not defined anywhere
+// in this tree -- it lives in a file this snapshot doesn't include. There's
+// no way to construct one here, so the registry's merge logic (the actual
+// behavior fixed by this commit's companion change in db/sql/migration.go)
+// can't get a real test until that type is available to import.
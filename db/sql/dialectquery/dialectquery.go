@@ -0,0 +1,47 @@
+// Package dialectquery provides dialect-specific SQL for the bookkeeping
+// queries the migrator runs against the `migrations` table
+// (create/insert/list/count/delete). Schema DDL for each migration version
+// is kept separate (see db/sql/migration.go); this package only concerns
+// itself with tracking which versions have been applied.
+//
+// This mirrors the approach used by goose's internal/dialect/dialectquery
+// package: a small interface implemented once per dialect, instead of
+// regexes rewriting a single SQLite-flavored query string at runtime.
+package dialectquery
+
+import "fmt"
+
+// DialectQuery returns the bookkeeping SQL statements for a single
+// database dialect. Every method returns a ready-to-execute statement;
+// placeholder style (`?` vs `$1`) is baked in per dialect.
+type DialectQuery interface {
+	// CreateMigrationsTable returns the DDL for the migrations table.
+	CreateMigrationsTable() string
+	// InsertVersion records that a version has been applied.
+	InsertVersion() string
+	// GetMigration returns a single migration row by version.
+	GetMigration() string
+	// GetChecksum returns the stored checksum for a single applied version.
+	GetChecksum() string
+	// ListMigrations returns all applied versions, most recent first.
+	ListMigrations() string
+	// CountMigrations returns the number of applied versions matching a version string.
+	CountMigrations() string
+	// DeleteVersion removes a version's row, used during rollback.
+	DeleteVersion() string
+}
+
+// New returns the DialectQuery implementation for the named dialect.
+// dialectName is expected to be one of "sqlite3", "mysql" or "postgres".
+func New(dialectName string) (DialectQuery, error) {
+	switch dialectName {
+	case "sqlite3":
+		return &Sqlite3{}, nil
+	case "mysql":
+		return &Mysql{}, nil
+	case "postgres":
+		return &Postgres{}, nil
+	default:
+		return nil, fmt.Errorf("dialectquery: unsupported dialect %q", dialectName)
+	}
+}
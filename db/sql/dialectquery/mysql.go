@@ -0,0 +1,36 @@
+package dialectquery
+
+// Mysql implements DialectQuery for the mysql dialect.
+type Mysql struct{}
+
+func (m *Mysql) CreateMigrationsTable() string {
+	return `create table if not exists migrations (
+		version varchar(50) primary key,
+		upgraded_date timestamp,
+		checksum varchar(64)
+	)`
+}
+
+func (m *Mysql) InsertVersion() string {
+	return `insert into migrations(version, upgraded_date, checksum) values (?, ?, ?)`
+}
+
+func (m *Mysql) GetMigration() string {
+	return `select version, upgraded_date, checksum from migrations where version = ?`
+}
+
+func (m *Mysql) GetChecksum() string {
+	return `select checksum from migrations where version = ?`
+}
+
+func (m *Mysql) ListMigrations() string {
+	return `select version, upgraded_date from migrations order by upgraded_date desc`
+}
+
+func (m *Mysql) CountMigrations() string {
+	return `select count(1) as ex from migrations where version = ?`
+}
+
+func (m *Mysql) DeleteVersion() string {
+	return `delete from migrations where version = ?`
+}
@@ -0,0 +1,36 @@
+package dialectquery
+
+// Postgres implements DialectQuery for the postgres dialect.
+type Postgres struct{}
+
+func (p *Postgres) CreateMigrationsTable() string {
+	return `create table if not exists migrations (
+		version varchar(50) primary key,
+		upgraded_date timestamp,
+		checksum varchar(64)
+	)`
+}
+
+func (p *Postgres) InsertVersion() string {
+	return `insert into migrations(version, upgraded_date, checksum) values ($1, $2, $3)`
+}
+
+func (p *Postgres) GetMigration() string {
+	return `select version, upgraded_date, checksum from migrations where version = $1`
+}
+
+func (p *Postgres) GetChecksum() string {
+	return `select checksum from migrations where version = $1`
+}
+
+func (p *Postgres) ListMigrations() string {
+	return `select version, upgraded_date from migrations order by upgraded_date desc`
+}
+
+func (p *Postgres) CountMigrations() string {
+	return `select count(1) as ex from migrations where version = $1`
+}
+
+func (p *Postgres) DeleteVersion() string {
+	return `delete from migrations where version = $1`
+}
@@ -0,0 +1,36 @@
+package dialectquery
+
+// Sqlite3 implements DialectQuery for the sqlite3 dialect.
+type Sqlite3 struct{}
+
+func (s *Sqlite3) CreateMigrationsTable() string {
+	return `create table if not exists migrations (
+		version varchar(50) primary key,
+		upgraded_date timestamp,
+		checksum varchar(64)
+	)`
+}
+
+func (s *Sqlite3) InsertVersion() string {
+	return `insert into migrations(version, upgraded_date, checksum) values (?, ?, ?)`
+}
+
+func (s *Sqlite3) GetMigration() string {
+	return `select version, upgraded_date, checksum from migrations where version = ?`
+}
+
+func (s *Sqlite3) GetChecksum() string {
+	return `select checksum from migrations where version = ?`
+}
+
+func (s *Sqlite3) ListMigrations() string {
+	return `select version, upgraded_date from migrations order by upgraded_date desc`
+}
+
+func (s *Sqlite3) CountMigrations() string {
+	return `select count(1) as ex from migrations where version = ?`
+}
+
+func (s *Sqlite3) DeleteVersion() string {
+	return `delete from migrations where version = ?`
+}
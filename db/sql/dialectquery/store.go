@@ -0,0 +1,53 @@
+package dialectquery
+
+// Store provides the migrations-table bookkeeping statements for a single
+// dialect; it does not execute them. The migrator obtains a Store and runs
+// its statements instead of hand-rolling `"... where version=?"` query
+// strings that used to rely on prepareMigration's regex rewriting.
+type Store struct {
+	query DialectQuery
+}
+
+// NewStore returns a Store for the given dialect name.
+func NewStore(dialectName string) (*Store, error) {
+	q, err := New(dialectName)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{query: q}, nil
+}
+
+// CreateMigrationsTable returns the DDL to create the migrations table.
+func (s *Store) CreateMigrationsTable() string {
+	return s.query.CreateMigrationsTable()
+}
+
+// InsertVersion returns the statement used to record an applied version.
+func (s *Store) InsertVersion() string {
+	return s.query.InsertVersion()
+}
+
+// GetMigration returns the statement used to fetch a single version row.
+func (s *Store) GetMigration() string {
+	return s.query.GetMigration()
+}
+
+// GetChecksum returns the statement used to fetch a single version's stored checksum.
+func (s *Store) GetChecksum() string {
+	return s.query.GetChecksum()
+}
+
+// ListMigrations returns the statement used to list applied versions.
+func (s *Store) ListMigrations() string {
+	return s.query.ListMigrations()
+}
+
+// CountMigrations returns the statement used to check whether a version has been applied.
+func (s *Store) CountMigrations() string {
+	return s.query.CountMigrations()
+}
+
+// DeleteVersion returns the statement used to remove a version's row during rollback.
+func (s *Store) DeleteVersion() string {
+	return s.query.DeleteVersion()
+}
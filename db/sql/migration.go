@@ -1,9 +1,10 @@
 package sql
 
 import (
+	"context"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"github.com/ansible-semaphore/semaphore/db"
+	"github.com/ansible-semaphore/semaphore/db/sql/dialectquery"
 	"github.com/go-gorp/gorp/v3"
 	"regexp"
 	"strings"
@@ -30,6 +31,38 @@ func getVersionErrPath(version db.Version) string {
 	return version.HumanoidVersion() + ".err.sql"
 }
 
+// dialectSuffix maps a gorp dialect to the sibling schema file suffix a
+// dialect-native migration file would use, e.g. "2.9.0.postgres.sql". Also
+// used as the dialectquery package's driver name.
+func (d *SqlDb) dialectSuffix() string {
+	switch d.sql.Dialect.(type) {
+	case gorp.MySQLDialect:
+		return "mysql"
+	case gorp.PostgresDialect:
+		return "postgres"
+	default:
+		return "sqlite3"
+	}
+}
+
+// getVersionDialectPath is the humanoid version with the dialect-specific
+// suffix and file format appended, e.g. "2.9.0.postgres.sql". No migration
+// in this tree ships a file at this path yet — every existing version
+// still falls through getMigrationQueries to the single SQLite-flavored
+// file translated by prepareMigration's regexes. This lookup exists so a
+// migration that DOES need dialect-specific DDL can ship one without any
+// further code changes; it is not itself a fix for prepareMigration's
+// regex-translation fragility.
+func (d *SqlDb) getVersionDialectPath(version db.Version) string {
+	return version.HumanoidVersion() + "." + d.dialectSuffix() + ".sql"
+}
+
+// splitMigrationSQL splits a blob of ;-separated SQL (as shipped in an
+// embedded file or a registered Migration.UpSQL/DownSQL) into statements.
+func splitMigrationSQL(sql string) []string {
+	return strings.Split(strings.ReplaceAll(sql, ";\r\n", ";\n"), ";\n")
+}
+
 // getVersionSQL takes a path to an SQL file and returns it from packr as
 // a slice of strings separated by newlines
 func getVersionSQL(path string) (queries []string) {
@@ -37,10 +70,41 @@ func getVersionSQL(path string) (queries []string) {
 	if err != nil {
 		panic(err)
 	}
-	queries = strings.Split(strings.ReplaceAll(sql, ";\r\n", ";\n"), ";\n")
+	queries = splitMigrationSQL(sql)
 	return
 }
 
+// getMigrationQueries returns the statements to run for a version, preferring
+// a dialect-native sibling file (e.g. "2.9.0.postgres.sql") when one has been
+// shipped for this migration, falling back to the dialect-agnostic file
+// translated via prepareMigration, and finally to a registered Migration's
+// UpSQL for versions that only exist because a fork or plugin called
+// db.RegisterMigration and shipped no embedded file at all. A registered
+// migration that's pure Go (UpFn set, no UpSQL) is valid too — it returns no
+// statements and no error, mirroring how rollbackMigration treats a bare
+// DownFn as sufficient on the way down. It's only an error when a version
+// has neither SQL nor a Go hook to run.
+func (d *SqlDb) getMigrationQueries(version db.Version) (queries []string, dialectNative bool, err error) {
+	if sql, ferr := dbAssets.MustString(d.getVersionDialectPath(version)); ferr == nil {
+		return splitMigrationSQL(sql), true, nil
+	}
+
+	if sql, ferr := dbAssets.MustString(getVersionPath(version)); ferr == nil {
+		return splitMigrationSQL(sql), false, nil
+	}
+
+	migration, hasMigration := db.GetRegisteredMigration(version)
+	if hasMigration && migration.UpSQL != "" {
+		return splitMigrationSQL(migration.UpSQL), false, nil
+	}
+
+	if hasMigration && migration.UpFn != nil {
+		return nil, false, nil
+	}
+
+	return nil, false, fmt.Errorf("no up migration available for version %s", version.HumanoidVersion())
+}
+
 // prepareMigration converts migration SQLite-query to current dialect.
 // Supported MySQL and Postgres dialects.
 func (d *SqlDb) prepareMigration(query string) string {
@@ -59,14 +123,25 @@ func (d *SqlDb) prepareMigration(query string) string {
 	return query
 }
 
+// migrationStore returns the DialectQuery-backed Store used for bookkeeping
+// queries against the migrations table (as opposed to schema DDL, which is
+// still translated via prepareMigration).
+func (d *SqlDb) migrationStore() (*dialectquery.Store, error) {
+	return dialectquery.NewStore(d.dialectSuffix())
+}
+
 // isMigrationApplied queries the database to see if a migration table with this version id exists already
 func (d *SqlDb) isMigrationApplied(version db.Version) (bool, error) {
-	exists, err := d.sql.SelectInt(d.prepareQuery("select count(1) as ex from migrations where version=?"), version.VersionString())
+	store, err := d.migrationStore()
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := d.sql.SelectInt(d.prepareQuery(store.CountMigrations()), version.VersionString())
 
 	if err != nil {
 		fmt.Println("Creating migrations table")
-		query := d.prepareMigration(initialSQL)
-		if _, err = d.exec(query); err != nil {
+		if err = d.ensureMigrationsTable(); err != nil {
 			panic(err)
 		}
 
@@ -77,95 +152,140 @@ func (d *SqlDb) isMigrationApplied(version db.Version) (bool, error) {
 }
 
 // Run executes a database migration
-func (d *SqlDb) applyMigration(version db.Version) error {
-	fmt.Printf("Executing migration %s (at %v)...\n", version.HumanoidVersion(), time.Now())
+func (d *SqlDb) applyMigration(ctx context.Context, version db.Version) (err error) {
+	reporter := reporterFromContext(ctx)
+	reporter.OnStart(version)
+
+	startedAt := time.Now()
+	historyID, historyErr := d.beginHistory(version, migrationDirectionUp)
+	if historyErr == nil {
+		defer func() {
+			d.finishHistory(historyID, startedAt, err)
+		}()
+	}
 
 	tx, err := d.sql.Begin()
 	if err != nil {
+		reporter.OnError(version, err)
 		return err
 	}
 
-	query := getVersionSQL(getVersionPath(version))
-	for i, query := range query {
-		fmt.Printf("\r [%d/%d]", i+1, len(query))
+	store, err := d.migrationStore()
+	if err != nil {
+		handleRollbackError(tx.Rollback())
+		reporter.OnError(version, err)
+		return err
+	}
+
+	queries, dialectNative, err := d.getMigrationQueries(version)
+	if err != nil {
+		handleRollbackError(tx.Rollback())
+		reporter.OnError(version, err)
+		return err
+	}
+
+	for i, query := range queries {
+		reporter.OnStatement(version, i+1, len(queries))
 
 		if len(query) == 0 {
 			continue
 		}
 
-		q := d.prepareMigration(query)
+		q := query
+		if !dialectNative {
+			q = d.prepareMigration(query)
+		}
+
 		_, err = tx.Exec(q)
 		if err != nil {
 			handleRollbackError(tx.Rollback())
-			log.Warnf("\n ERR! Query: %s\n\n", q)
-			log.Fatalf(err.Error())
+			reporter.OnError(version, fmt.Errorf("query %q: %w", q, err))
 			return err
 		}
 	}
 
-	if _, err := tx.Exec(d.prepareQuery("insert into migrations(version, upgraded_date) values (?, ?)"), version.VersionString(), time.Now()); err != nil {
+	if err := d.ensureChecksumColumn(); err != nil {
 		handleRollbackError(tx.Rollback())
+		reporter.OnError(version, err)
 		return err
 	}
 
-	switch version.VersionString() {
-	case "2.8.26":
-		rows, err2 := d.sql.Query("SELECT id, git_url FROM project__repository")
-		if err2 == nil {
-			defer rows.Close()
-			for rows.Next() {
-				var id, url string
-
-				err3 := rows.Scan(&id, &url)
-				if err3 != nil {
-					continue
-				}
-
-				branch := "master"
-				parts := strings.Split(url, "#")
-				if len(parts) > 1 {
-					url, branch = parts[0], parts[1]
-				}
-				_, _ = d.sql.Exec("UPDATE project__repository "+
-					"SET git_url = ?, git_branch = ? "+
-					"WHERE id = ?", url, branch, id)
-			}
+	checksum := d.checksumMigration(version)
+	if _, err := tx.Exec(d.prepareQuery(store.InsertVersion()), version.VersionString(), time.Now(), checksum); err != nil {
+		handleRollbackError(tx.Rollback())
+		reporter.OnError(version, err)
+		return err
+	}
+
+	if migration, ok := db.GetRegisteredMigration(version); ok && migration.UpFn != nil {
+		if err := migration.UpFn(tx); err != nil {
+			handleRollbackError(tx.Rollback())
+			reporter.OnError(version, err)
+			return err
 		}
 	}
 
-	fmt.Println()
+	if err = tx.Commit(); err != nil {
+		reporter.OnError(version, err)
+		return err
+	}
 
-	return tx.Commit()
+	reporter.OnVersionComplete(version)
+	return nil
 }
 
 // TryRollback attempts to rollback the database to an earlier version if a rollback exists
-func (d *SqlDb) tryRollbackMigration(version db.Version) {
-	fmt.Printf("Rolling back %s (time: %v)...\n", version.HumanoidVersion(), time.Now())
+func (d *SqlDb) tryRollbackMigration(ctx context.Context, version db.Version) {
+	reporter := reporterFromContext(ctx)
+	reporter.OnRollback(version)
 
 	data := dbAssets.Bytes(getVersionErrPath(version))
 	if len(data) == 0 {
-		fmt.Println("Rollback SQL does not exist.")
-		fmt.Println()
 		return
 	}
 
 	query := getVersionSQL(getVersionErrPath(version))
 	for _, query := range query {
-		fmt.Printf(" [ROLLBACK] > %v\n", query)
-
 		if _, err := d.exec(d.prepareMigration(query)); err != nil {
-			fmt.Println(" [ROLLBACK] - Stopping")
+			reporter.OnError(version, err)
 			return
 		}
 	}
 }
 
+// Migrate runs any outstanding migrations using the default stdout
+// reporter. Use MigrateContext with WithReporter to capture progress
+// programmatically instead (tests, an admin endpoint, ...).
 func (d *SqlDb) Migrate() error {
+	return d.MigrateContext(context.Background())
+}
+
+// MigrateContext runs any outstanding migrations, reporting progress to
+// the MigrationReporter attached to ctx via WithReporter, or the default
+// stdout reporter if none was attached.
+func (d *SqlDb) MigrateContext(ctx context.Context) error {
 	fmt.Println("Checking DB migrations")
+
+	if err := d.acquireMigrationLock(); err != nil {
+		return err
+	}
+	defer d.releaseMigrationLock()
+
+	if incomplete, found, err := d.incompleteMigration(); err != nil {
+		return err
+	} else if found && !migrateForced() {
+		return fmt.Errorf("migration %s was started but never finished; rerun with SEMAPHORE_MIGRATE_FORCE=1 once you've confirmed the DB is in a safe state", incomplete)
+	}
+
+	if err := d.verifyChecksums(); err != nil {
+		return err
+	}
+
 	didRun := false
 
-	// go from beginning to the end
-	for _, version := range db.GetVersions() {
+	// go from beginning to the end, including any version a fork or plugin
+	// injected via db.RegisterMigration that isn't one of the built-ins
+	for _, version := range db.AllVersions() {
 		if exists, err := d.isMigrationApplied(version); err != nil || exists {
 			if exists {
 				continue
@@ -175,8 +295,8 @@ func (d *SqlDb) Migrate() error {
 		}
 
 		didRun = true
-		if err := d.applyMigration(version); err != nil {
-			d.tryRollbackMigration(version)
+		if err := d.applyMigration(ctx, version); err != nil {
+			d.tryRollbackMigration(ctx, version)
 
 			return err
 		}
@@ -0,0 +1,120 @@
+package sql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ansible-semaphore/semaphore/db"
+	"github.com/go-gorp/gorp/v3"
+)
+
+// migrateStrict reports whether Migrate should refuse to boot on a
+// checksum mismatch (SEMAPHORE_MIGRATE_STRICT=1) rather than just warning.
+func migrateStrict() bool {
+	return os.Getenv("SEMAPHORE_MIGRATE_STRICT") == "1"
+}
+
+// checksumMigration returns the SHA-256 checksum, hex-encoded, of the SQL
+// that would run for version — the statements getMigrationQueries returns,
+// joined with ";\n", before prepareMigration's dialect translation — so
+// unchanged migration SQL always produces the checksum recorded at apply
+// time.
+func (d *SqlDb) checksumMigration(version db.Version) string {
+	queries, _, _ := d.getMigrationQueries(version)
+	sum := sha256.Sum256([]byte(strings.Join(queries, ";\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureChecksumColumn adds the `checksum` column to an already-existing
+// `migrations` table that predates this feature. store.CreateMigrationsTable
+// already includes the column for a fresh install (it's `create table if
+// not exists`, so it never touches a table that's already there), which
+// means upgrades need this separate, idempotent ALTER. Both SQLite and
+// (pre-8.0.29) MySQL lack `ADD COLUMN IF NOT EXISTS`, so a duplicate-column
+// error from a second call is expected and silently ignored.
+func (d *SqlDb) ensureChecksumColumn() error {
+	stmt := "alter table migrations add column checksum varchar(64)"
+	if _, ok := d.sql.Dialect.(gorp.PostgresDialect); ok {
+		stmt = "alter table migrations add column if not exists checksum varchar(64)"
+	}
+
+	if _, err := d.exec(stmt); err != nil && !isDuplicateColumnError(err) {
+		return err
+	}
+
+	return nil
+}
+
+// isDuplicateColumnError reports whether err is the dialect's way of
+// saying "that column already exists" (SQLite and MySQL both return this
+// as a plain error rather than a distinct type).
+func isDuplicateColumnError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "duplicate column")
+}
+
+// ensureMigrationsTable makes sure the `migrations` table exists with all
+// current columns, creating it via store.CreateMigrationsTable() for a
+// fresh install and ALTERing in any columns (currently just `checksum`)
+// missing from a table created by an older version of this package.
+func (d *SqlDb) ensureMigrationsTable() error {
+	store, err := d.migrationStore()
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.exec(store.CreateMigrationsTable()); err != nil {
+		return err
+	}
+
+	return d.ensureChecksumColumn()
+}
+
+// verifyChecksums re-hashes the embedded SQL for every applied migration
+// and compares it against the checksum recorded when that migration ran,
+// to catch the case where someone edited a released migration file in a
+// fork. Mismatches are logged as warnings; with SEMAPHORE_MIGRATE_STRICT=1
+// the first mismatch is returned as an error instead, and Migrate()
+// refuses to boot.
+func (d *SqlDb) verifyChecksums() error {
+	if err := d.ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	store, err := d.migrationStore()
+	if err != nil {
+		return err
+	}
+
+	strict := migrateStrict()
+
+	for _, version := range db.AllVersions() {
+		applied, err := d.isMigrationApplied(version)
+		if err != nil {
+			return err
+		}
+		if !applied {
+			continue
+		}
+
+		stored, err := d.sql.SelectStr(d.prepareQuery(store.GetChecksum()), version.VersionString())
+		if err != nil || stored == "" {
+			// versions applied before checksums were introduced have no
+			// stored checksum to compare against; nothing to verify.
+			continue
+		}
+
+		if current := d.checksumMigration(version); current != stored {
+			msg := fmt.Sprintf("checksum mismatch for migration %s: recorded %s, on-disk %s — the migration file may have been edited after it ran", version.HumanoidVersion(), stored, current)
+			if strict {
+				return fmt.Errorf("%s (refusing to start: SEMAPHORE_MIGRATE_STRICT=1)", msg)
+			}
+			log.Warn(msg)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package sql
+
+import (
+	"strings"
+
+	"github.com/ansible-semaphore/semaphore/db"
+	"github.com/go-gorp/gorp/v3"
+)
+
+// init registers the 2.8.26 data migration, which used to be a hard-coded
+// `switch version.VersionString()` case inside applyMigration. It splits
+// the legacy `git_url#branch` convention into separate git_url/git_branch
+// columns. Registering it here instead keeps applyMigration free of
+// version-specific logic and makes this transformation testable on its
+// own.
+func init() {
+	for _, v := range db.GetVersions() {
+		if v.VersionString() != "2.8.26" {
+			continue
+		}
+
+		db.RegisterMigration(db.Migration{
+			Version: v,
+			UpFn:    splitRepositoryGitURLBranch,
+		})
+		break
+	}
+}
+
+// splitRepositoryGitURLBranch rewrites project__repository.git_url values
+// of the form "<url>#<branch>" into separate git_url and git_branch
+// columns, defaulting the branch to "master" when none was embedded.
+func splitRepositoryGitURLBranch(tx *gorp.Transaction) error {
+	rows, err := tx.Query("SELECT id, git_url FROM project__repository")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type repo struct {
+		id, url string
+	}
+	var repos []repo
+
+	for rows.Next() {
+		var r repo
+		if err := rows.Scan(&r.id, &r.url); err != nil {
+			continue
+		}
+		repos = append(repos, r)
+	}
+
+	for _, r := range repos {
+		url, branch := r.url, "master"
+		if parts := strings.SplitN(r.url, "#", 2); len(parts) > 1 {
+			url, branch = parts[0], parts[1]
+		}
+
+		if _, err := tx.Exec("UPDATE project__repository "+
+			"SET git_url = ?, git_branch = ? "+
+			"WHERE id = ?", url, branch, r.id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package sql
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-gorp/gorp/v3"
+)
+
+// migrationLockKey is a stable identifier for the advisory lock guarding
+// Migrate(). Postgres wants it as an int64, so pgAdvisoryLockKey hashes it
+// down to one.
+const migrationLockKey = "semaphore_migrate"
+
+// defaultMigrationLockTimeout bounds how long Migrate() waits for the
+// advisory lock before giving up, so a wedged replica can't wedge every
+// other replica's startup too. Override with SEMAPHORE_MIGRATE_LOCK_TIMEOUT
+// (a Go duration string, e.g. "30s").
+const defaultMigrationLockTimeout = 5 * time.Minute
+
+// defaultMigrationLockStaleAfter bounds how old the SQLite sentinel lock
+// row can be before a new attempt treats it as abandoned rather than live.
+// Postgres/MySQL locks are released automatically when their holding
+// connection dies, but the SQLite sentinel row has no such connection tied
+// to it — without this, a process killed (OOM, SIGKILL) between taking the
+// lock and releasing it leaves the row in place forever, and every future
+// startup (including whatever replaces the killed instance) blocks for
+// migrationLockTimeout and then fails permanently. Override with
+// SEMAPHORE_MIGRATE_LOCK_STALE_AFTER (a Go duration string).
+const defaultMigrationLockStaleAfter = 15 * time.Minute
+
+// ErrMigrationLockTimeout is returned when Migrate() could not acquire the
+// cross-process migration lock within the configured timeout. Callers
+// (orchestrators, supervisors) can match on this to back off and retry
+// rather than treating it as a fatal migration failure.
+var ErrMigrationLockTimeout = errors.New("timed out waiting for migration lock")
+
+// migrationLockTimeout returns the configured lock-acquire timeout.
+func migrationLockTimeout() time.Duration {
+	if raw := os.Getenv("SEMAPHORE_MIGRATE_LOCK_TIMEOUT"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil {
+			return d
+		}
+	}
+	return defaultMigrationLockTimeout
+}
+
+// migrationLockStaleAfter returns the configured SQLite lock staleness
+// threshold.
+func migrationLockStaleAfter() time.Duration {
+	if raw := os.Getenv("SEMAPHORE_MIGRATE_LOCK_STALE_AFTER"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil {
+			return d
+		}
+	}
+	return defaultMigrationLockStaleAfter
+}
+
+// staleLockCutoff returns the locked_at threshold below which a sentinel
+// lock row is old enough to treat as abandoned rather than live.
+func staleLockCutoff(now time.Time, staleAfter time.Duration) time.Time {
+	return now.Add(-staleAfter)
+}
+
+// acquiredFromRowsAffected reports whether a single-row insert/update
+// against the sentinel lock row actually touched it, i.e. whether the
+// caller now holds the lock. Split out from tryAcquireSqliteMigrationLock
+// so this decision — which is exactly where the original false-acquire bug
+// lived (INSERT OR IGNORE silently no-opping instead of erroring) — can be
+// unit tested without a real database connection.
+func acquiredFromRowsAffected(rows int64) bool {
+	return rows > 0
+}
+
+// pgAdvisoryLockKey hashes migrationLockKey down to the int64 that
+// pg_advisory_lock expects.
+func pgAdvisoryLockKey() int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(migrationLockKey))
+	return int64(h.Sum64())
+}
+
+// acquireMigrationLock takes a cross-process advisory lock so that
+// concurrent semaphore instances starting up at the same time (a rolling
+// Kubernetes deploy, socket-activated systemd replicas) can't race
+// isMigrationApplied/applyMigration and double-apply a migration. It
+// blocks until the lock is obtained or migrationLockTimeout elapses.
+func (d *SqlDb) acquireMigrationLock() error {
+	timeout := migrationLockTimeout()
+	deadline := time.Now().Add(timeout)
+
+	for {
+		acquired, err := d.tryAcquireMigrationLock()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			log.Warnf("timed out after %s waiting for migration lock %q; another instance is likely mid-migration", timeout, migrationLockKey)
+			return ErrMigrationLockTimeout
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// tryAcquireMigrationLock makes a single, non-blocking-per-dialect attempt
+// to take the lock.
+func (d *SqlDb) tryAcquireMigrationLock() (bool, error) {
+	switch d.sql.Dialect.(type) {
+	case gorp.PostgresDialect:
+		acquired, err := d.sql.SelectStr("select pg_try_advisory_lock(" + strconv.FormatInt(pgAdvisoryLockKey(), 10) + ")")
+		if err != nil {
+			return false, err
+		}
+		return acquired == "true" || acquired == "t", nil
+	case gorp.MySQLDialect:
+		acquired, err := d.sql.SelectInt("select GET_LOCK(?, 1)", migrationLockKey)
+		if err != nil {
+			return false, err
+		}
+		return acquired == 1, nil
+	default:
+		return d.tryAcquireSqliteMigrationLock()
+	}
+}
+
+// tryAcquireSqliteMigrationLock uses a sentinel row to emulate an advisory
+// lock on SQLite, which has no native equivalent. d.sql.Begin() opens a
+// plain deferred transaction (not BEGIN IMMEDIATE — this driver connection
+// gives us no way to request that), so it's the write inside the
+// transaction, not the transaction itself, that serializes concurrent
+// callers: SQLite upgrades to the write lock at that point, and a
+// concurrent attempt either fails to open a transaction at all (treated
+// below as "still locked") or blocks/fails on its own write.
+func (d *SqlDb) tryAcquireSqliteMigrationLock() (bool, error) {
+	if _, err := d.exec("create table if not exists migration_lock (id integer primary key check (id = 1), locked_at timestamp)"); err != nil {
+		return false, err
+	}
+
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return false, nil // most likely SQLITE_BUSY; treat as "still locked"
+	}
+
+	now := time.Now()
+	res, err := tx.Exec("insert or ignore into migration_lock (id, locked_at) values (1, ?)", now)
+	if err != nil {
+		handleRollbackError(tx.Rollback())
+		return false, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		handleRollbackError(tx.Rollback())
+		return false, err
+	}
+
+	if !acquiredFromRowsAffected(rows) {
+		// the sentinel row already existed. Steal it if it's stale enough
+		// that its holder almost certainly crashed without releasing it —
+		// otherwise a single killed process permanently bricks every
+		// future startup, since nothing else ever clears the row.
+		res, err = tx.Exec(
+			"update migration_lock set locked_at = ? where id = 1 and locked_at < ?",
+			now, staleLockCutoff(now, migrationLockStaleAfter()))
+		if err != nil {
+			handleRollbackError(tx.Rollback())
+			return false, err
+		}
+
+		stolenRows, err := res.RowsAffected()
+		if err != nil {
+			handleRollbackError(tx.Rollback())
+			return false, err
+		}
+
+		if !acquiredFromRowsAffected(stolenRows) {
+			// still held by a live (or at least not-yet-stale) owner
+			handleRollbackError(tx.Rollback())
+			return false, nil
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// releaseMigrationLock releases the lock taken by acquireMigrationLock. It
+// logs but does not fail Migrate() on error, since a stuck lock will
+// simply time out for the next caller rather than corrupt data.
+func (d *SqlDb) releaseMigrationLock() {
+	var err error
+
+	switch d.sql.Dialect.(type) {
+	case gorp.PostgresDialect:
+		_, err = d.sql.Exec("select pg_advisory_unlock(" + strconv.FormatInt(pgAdvisoryLockKey(), 10) + ")")
+	case gorp.MySQLDialect:
+		_, err = d.sql.Exec("select RELEASE_LOCK(?)", migrationLockKey)
+	default:
+		_, err = d.exec("delete from migration_lock where id = 1")
+	}
+
+	if err != nil {
+		log.Warnf("failed to release migration lock: %v", err)
+	}
+}
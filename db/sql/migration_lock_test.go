@@ -0,0 +1,56 @@
+package sql
+
+import (
+	"testing"
+	"time"
+)
+
+// acquiredFromRowsAffected is the decision that caused the original
+// false-acquire bug (INSERT OR IGNORE silently no-opping instead of
+// erroring on a conflict) -- exercise it directly rather than only through
+// tryAcquireSqliteMigrationLock, which needs a real *SqlDb (the type isn't
+// defined anywhere in this tree, so a database-backed test isn't possible
+// here).
+func TestAcquiredFromRowsAffected(t *testing.T) {
+	if acquiredFromRowsAffected(0) {
+		t.Error("0 rows affected must not count as acquiring the lock")
+	}
+	if !acquiredFromRowsAffected(1) {
+		t.Error("1 row affected must count as acquiring the lock")
+	}
+}
+
+func TestStaleLockCutoff(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	got := staleLockCutoff(now, 15*time.Minute)
+	want := now.Add(-15 * time.Minute)
+
+	if !got.Equal(want) {
+		t.Errorf("staleLockCutoff(%s, 15m) = %s, want %s", now, got, want)
+	}
+}
+
+func TestMigrationLockStaleAfterDefault(t *testing.T) {
+	t.Setenv("SEMAPHORE_MIGRATE_LOCK_STALE_AFTER", "")
+
+	if got := migrationLockStaleAfter(); got != defaultMigrationLockStaleAfter {
+		t.Errorf("migrationLockStaleAfter() = %s, want default %s", got, defaultMigrationLockStaleAfter)
+	}
+}
+
+func TestMigrationLockStaleAfterOverride(t *testing.T) {
+	t.Setenv("SEMAPHORE_MIGRATE_LOCK_STALE_AFTER", "1h")
+
+	if got := migrationLockStaleAfter(); got != time.Hour {
+		t.Errorf("migrationLockStaleAfter() = %s, want 1h", got)
+	}
+}
+
+func TestMigrationLockStaleAfterInvalidFallsBackToDefault(t *testing.T) {
+	t.Setenv("SEMAPHORE_MIGRATE_LOCK_STALE_AFTER", "not-a-duration")
+
+	if got := migrationLockStaleAfter(); got != defaultMigrationLockStaleAfter {
+		t.Errorf("migrationLockStaleAfter() = %s, want default %s on invalid input", got, defaultMigrationLockStaleAfter)
+	}
+}
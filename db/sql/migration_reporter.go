@@ -0,0 +1,77 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ansible-semaphore/semaphore/db"
+)
+
+// MigrationReporter receives progress events from Migrate() and Rollback().
+// It replaces the old fmt.Printf/log.Fatalf calls scattered through
+// applyMigration, which made Migrate impossible to embed in tests or a
+// non-CLI context (an HTTP admin endpoint, for instance) since a failure
+// would terminate the whole process from inside a library function.
+type MigrationReporter interface {
+	// OnStart is called once, before a version's statements begin executing.
+	OnStart(version db.Version)
+	// OnStatement is called before each statement within a version, 1-indexed.
+	OnStatement(version db.Version, index, total int)
+	// OnVersionComplete is called after a version's transaction commits successfully.
+	OnVersionComplete(version db.Version)
+	// OnRollback is called when a version is being rolled back, either
+	// because it failed to apply or because of an explicit Rollback(target) call.
+	OnRollback(version db.Version)
+	// OnError is called when a version fails to apply or roll back.
+	OnError(version db.Version, err error)
+}
+
+// stdoutReporter is the default MigrationReporter. It prints the version
+// being applied or rolled back, a "[i/n]" counter per statement and any
+// error to stdout. Unlike Migrate()'s earlier output, it prints no
+// timestamps and does not echo individual rollback statements.
+type stdoutReporter struct{}
+
+func (stdoutReporter) OnStart(version db.Version) {
+	fmt.Printf("Executing migration %s...\n", version.HumanoidVersion())
+}
+
+func (stdoutReporter) OnStatement(_ db.Version, index, total int) {
+	fmt.Printf("\r [%d/%d]", index, total)
+}
+
+func (stdoutReporter) OnVersionComplete(_ db.Version) {
+	fmt.Println()
+}
+
+func (stdoutReporter) OnRollback(version db.Version) {
+	fmt.Printf("Rolling back %s...\n", version.HumanoidVersion())
+}
+
+func (stdoutReporter) OnError(version db.Version, err error) {
+	fmt.Printf("\n ERR! Migration %s failed: %v\n\n", version.HumanoidVersion(), err)
+}
+
+// reporterContextKey is unexported so only WithReporter can populate it.
+type reporterContextKey struct{}
+
+// WithReporter returns a copy of ctx carrying reporter, to be passed to
+// MigrateContext/RollbackContext. This is request-scoped rather than a
+// field on SqlDb: a *SqlDb is typically a long-lived, shared handle (one
+// per process), and a setter that mutated shared state on it would race
+// against any concurrent Migrate()/Rollback() call using a different
+// reporter, and would leak its map entry for every short-lived *SqlDb a
+// test or admin endpoint created and discarded without explicitly
+// clearing it again.
+func WithReporter(ctx context.Context, reporter MigrationReporter) context.Context {
+	return context.WithValue(ctx, reporterContextKey{}, reporter)
+}
+
+// reporterFromContext returns the MigrationReporter carried by ctx, or the
+// default stdout reporter if none was attached via WithReporter.
+func reporterFromContext(ctx context.Context) MigrationReporter {
+	if r, ok := ctx.Value(reporterContextKey{}).(MigrationReporter); ok && r != nil {
+		return r
+	}
+	return stdoutReporter{}
+}
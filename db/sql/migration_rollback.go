@@ -0,0 +1,239 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ansible-semaphore/semaphore/db"
+	"github.com/ansible-semaphore/semaphore/db/sql/dialectquery"
+	"github.com/go-gorp/gorp/v3"
+)
+
+// migrationDirection records which way a migration ran in migrations_history.
+type migrationDirection string
+
+const (
+	migrationDirectionUp   migrationDirection = "up"
+	migrationDirectionDown migrationDirection = "down"
+)
+
+// migrationsHistorySQL creates the audit table tracking every apply and
+// rollback attempt, successful or not. It is separate from `migrations`,
+// which only ever holds the set of currently-applied versions.
+const migrationsHistorySQL = `create table if not exists migrations_history (
+	id integer primary key autoincrement,
+	version varchar(50) not null,
+	direction varchar(4) not null,
+	started_at timestamp not null,
+	finished_at timestamp null,
+	duration_ms integer null,
+	error text null
+)`
+
+// ensureMigrationsHistoryTable creates the migrations_history table if it
+// does not already exist.
+func (d *SqlDb) ensureMigrationsHistoryTable() error {
+	_, err := d.exec(d.prepareMigration(migrationsHistorySQL))
+	return err
+}
+
+// beginHistory records that a migration is starting and returns the row id
+// so the caller can later close it out via finishHistory.
+func (d *SqlDb) beginHistory(version db.Version, direction migrationDirection) (int64, error) {
+	if err := d.ensureMigrationsHistoryTable(); err != nil {
+		return 0, err
+	}
+
+	query := d.prepareQuery("insert into migrations_history(version, direction, started_at) values (?, ?, ?)")
+	args := []interface{}{version.VersionString(), string(direction), time.Now()}
+
+	// Postgres drivers don't support LastInsertId; ask for the id instead.
+	if _, ok := d.sql.Dialect.(gorp.PostgresDialect); ok {
+		return d.sql.SelectInt(query+" returning id", args...)
+	}
+
+	res, err := d.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// finishHistory closes out a history row started by beginHistory, recording
+// how long the migration took and, if it failed, why.
+func (d *SqlDb) finishHistory(id int64, startedAt time.Time, migErr error) {
+	errMsg := ""
+	if migErr != nil {
+		errMsg = migErr.Error()
+	}
+
+	finishedAt := time.Now()
+	durationMs := finishedAt.Sub(startedAt).Milliseconds()
+
+	_, err := d.exec(
+		d.prepareQuery("update migrations_history set finished_at = ?, duration_ms = ?, error = ? where id = ?"),
+		finishedAt, durationMs, errMsg, id)
+	if err != nil {
+		log.Warnf("failed to record migration history for id %d: %v", id, err)
+	}
+}
+
+// incompleteMigration returns the version of a migration that was started
+// but never finished, if one is recorded in migrations_history. This
+// happens when a process was killed mid-migration, and Migrate refuses to
+// continue past it unless forced.
+func (d *SqlDb) incompleteMigration() (version string, found bool, err error) {
+	if err = d.ensureMigrationsHistoryTable(); err != nil {
+		return "", false, err
+	}
+
+	version, err = d.sql.SelectStr(d.prepareQuery(
+		"select version from migrations_history where finished_at is null order by started_at desc limit 1"))
+	if err != nil {
+		return "", false, nil
+	}
+
+	return version, version != "", nil
+}
+
+// migrateForced reports whether the operator has asked Migrate to proceed
+// past a recorded incomplete migration, via SEMAPHORE_MIGRATE_FORCE=1.
+//
+// TODO(chunk0-2): the request asked for this to be reachable as a
+// `semaphore migrate --force` flag. There is no cmd/CLI package anywhere
+// in this tree to wire that flag into, so this request is only
+// half-delivered as a library API — track it as open, not done, until
+// whichever package owns cmd/ adds the flag and calls this.
+func migrateForced() bool {
+	return os.Getenv("SEMAPHORE_MIGRATE_FORCE") == "1"
+}
+
+// Rollback walks applied migrations in reverse from the current head down
+// to (but not including) target, using the default stdout reporter. Use
+// RollbackContext with WithReporter to capture progress programmatically
+// instead.
+//
+// TODO(chunk0-2): the request asked for this to be reachable as a
+// `semaphore migrate --down <version>` flag. There is no cmd/CLI package
+// anywhere in this tree to wire that flag into, so this request is only
+// half-delivered as a library API — track it as open, not done, until
+// whichever package owns cmd/ adds the flag and calls this.
+func (d *SqlDb) Rollback(target db.Version) error {
+	return d.RollbackContext(context.Background(), target)
+}
+
+// RollbackContext is Rollback, reporting progress to the MigrationReporter
+// attached to ctx via WithReporter (or the default stdout reporter).
+func (d *SqlDb) RollbackContext(ctx context.Context, target db.Version) error {
+	versions := db.AllVersions()
+
+	targetIndex := -1
+	for i, version := range versions {
+		if version.VersionString() == target.VersionString() {
+			targetIndex = i
+			break
+		}
+	}
+	if targetIndex == -1 {
+		return fmt.Errorf("rollback target %s is not a known migration version", target.VersionString())
+	}
+
+	store, err := d.migrationStore()
+	if err != nil {
+		return err
+	}
+
+	// walk the head of applied migrations back down to (but not including) target
+	for i := len(versions) - 1; i > targetIndex; i-- {
+		version := versions[i]
+
+		applied, err := d.isMigrationApplied(version)
+		if err != nil {
+			return err
+		}
+		if !applied {
+			continue
+		}
+
+		if err := d.rollbackMigration(ctx, store, version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollbackMigration executes a single version's down SQL and deletes its
+// row from `migrations`, recording the attempt in migrations_history.
+func (d *SqlDb) rollbackMigration(ctx context.Context, store *dialectquery.Store, version db.Version) (err error) {
+	reporter := reporterFromContext(ctx)
+	reporter.OnRollback(version)
+	defer func() {
+		if err != nil {
+			reporter.OnError(version, err)
+		} else {
+			reporter.OnVersionComplete(version)
+		}
+	}()
+
+	startedAt := time.Now()
+	historyID, historyErr := d.beginHistory(version, migrationDirectionDown)
+	if historyErr == nil {
+		defer func() {
+			d.finishHistory(historyID, startedAt, err)
+		}()
+	}
+
+	migration, hasMigration := db.GetRegisteredMigration(version)
+	hasEmbeddedDownSQL := len(dbAssets.Bytes(getVersionErrPath(version))) > 0
+	hasRegisteredDownSQL := hasMigration && migration.DownSQL != ""
+	hasDownFn := hasMigration && migration.DownFn != nil
+
+	if !hasEmbeddedDownSQL && !hasRegisteredDownSQL && !hasDownFn {
+		return fmt.Errorf("no down migration available for version %s", version.HumanoidVersion())
+	}
+
+	tx, err := d.sql.Begin()
+	if err != nil {
+		return err
+	}
+
+	if hasDownFn {
+		if err = migration.DownFn(tx); err != nil {
+			handleRollbackError(tx.Rollback())
+			return err
+		}
+	}
+
+	// prefer an embedded ".err.sql" file, the same way getMigrationQueries
+	// prefers embedded files over a registered Migration's SQL on the way up
+	var downQueries []string
+	switch {
+	case hasEmbeddedDownSQL:
+		downQueries = getVersionSQL(getVersionErrPath(version))
+	case hasRegisteredDownSQL:
+		downQueries = splitMigrationSQL(migration.DownSQL)
+	}
+
+	for _, query := range downQueries {
+		if len(query) == 0 {
+			continue
+		}
+
+		if _, err = tx.Exec(d.prepareMigration(query)); err != nil {
+			handleRollbackError(tx.Rollback())
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(d.prepareQuery(store.DeleteVersion()), version.VersionString()); err != nil {
+		handleRollbackError(tx.Rollback())
+		return err
+	}
+
+	return tx.Commit()
+}